@@ -2,166 +2,430 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var invalidNameCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
-var ignoreNameCharRE = regexp.MustCompile(`[%()]`)
+var (
+	invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	metricNameRE       = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// sanitizeLabelName lowercases name and replaces any character outside
+// [a-zA-Z0-9_] with an underscore, per the Prometheus data model. A name
+// that would start with a digit after sanitization is prefixed with an
+// underscore instead, since Prometheus identifiers may not start with one.
+func sanitizeLabelName(name string) string {
+	name = invalidLabelCharRE.ReplaceAllString(strings.ToLower(name), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// sanitizeLabelValue coerces v to valid UTF-8, replacing any invalid byte
+// sequences, since Prometheus label values must be valid UTF-8 strings.
+func sanitizeLabelValue(v string) string {
+	if utf8.ValidString(v) {
+		return v
+	}
+	return strings.ToValidUTF8(v, string(utf8.RuneError))
+}
+
+// validateMetricName checks name against Prometheus' metric name regex,
+// returning a descriptive error so callers can fail registration instead of
+// handing the registry a Desc it will panic on later.
+func validateMetricName(name string) error {
+	if !metricNameRE.MatchString(name) {
+		return fmt.Errorf("invalid metric name %q: must match %s", name, metricNameRE.String())
+	}
+	return nil
+}
+
+// ColumnUsage describes how SetMetrics should treat a single result column,
+// mirroring the column mapping design postgres_exporter uses for the same
+// problem.
+//
+// A ColumnCounter column's raw SQL value is reported as-is, on every scrape,
+// as a CounterValue ConstMetric. No last value or delta is kept on the client
+// side; reset detection is left to Prometheus' rate() over the scraped
+// series.
+type ColumnUsage string
+
+const (
+	ColumnDiscard   ColumnUsage = "DISCARD"
+	ColumnLabel     ColumnUsage = "LABEL"
+	ColumnCounter   ColumnUsage = "COUNTER"
+	ColumnGauge     ColumnUsage = "GAUGE"
+	ColumnHistogram ColumnUsage = "HISTOGRAM"
+)
+
+// ColumnMapping describes how one column of a query's result set should be
+// exposed as a Prometheus metric. Name defaults to the column name and Help
+// defaults to Query.Help when left blank.
+type ColumnMapping struct {
+	Name  string
+	Usage ColumnUsage
+	Help  string
+}
+
+// Query describes a single SQL query to run and how to expose its result(s)
+// as Prometheus metrics.
+type Query struct {
+	Name string
+	Help string
+
+	// Unit is appended to every metric name derived from this query, e.g.
+	// "seconds" or "bytes", per Prometheus naming conventions.
+	Unit string
+
+	// NamePrefix overrides the default "query_result_<Name>" prefix used to
+	// build each column's metric name.
+	NamePrefix string
+
+	// Metrics maps a result column name (case-insensitive) to how it should
+	// be exposed. Columns absent from Metrics are discarded, same as a
+	// column mapped to ColumnDiscard.
+	Metrics map[string]ColumnMapping
+
+	// Buckets defines the histogram buckets to use for any column mapped to
+	// ColumnHistogram.
+	Buckets []float64
+}
 
+// metricName builds the fully-qualified Prometheus metric name for a column,
+// honouring Query.NamePrefix and Query.Unit. Without a NamePrefix the name
+// is "query_result_<query>_<column>".
+func metricName(q *Query, col string) string {
+	prefix := q.NamePrefix
+	if prefix == "" {
+		prefix = fmt.Sprintf("query_result_%s", q.Name)
+	}
+	name := fmt.Sprintf("%s_%s", prefix, col)
+	if q.Unit != "" {
+		name = fmt.Sprintf("%s_%s", name, q.Unit)
+	}
+	return name
+}
+
+// facetValue is one row of a query's latest result: the variable label
+// values (in the same order as QueryResult.labelNames) and the value to
+// report for each COUNTER/GAUGE column, keyed by lowercased column name.
+//
+// COUNTER columns store the raw cumulative value straight through, with no
+// client-side last-value/delta bookkeeping: ConstMetric counters carry the
+// current cumulative total on every scrape, and Prometheus' own rate() does
+// reset detection against the scraped series.
+type facetValue struct {
+	labels []string
+	values map[string]float64
+}
+
+// metricSpec is the Desc and metadata for a single COUNTER/GAUGE column.
+type metricSpec struct {
+	fqName    string
+	help      string
+	usage     ColumnUsage
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+// QueryMetadata describes a single metric exposed by a running exporter, for
+// the /metadata endpoint - so operators can discover what's available
+// without reading the YAML that configured it.
+type QueryMetadata struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+	Unit string `json:"unit,omitempty"`
+	Type string `json:"type"`
+}
+
+// QueryResult implements prometheus.Collector directly. SetMetrics replaces
+// its held records wholesale on every poll, and Collect emits whatever is
+// current at scrape time - one ConstMetric per COUNTER/GAUGE column per row,
+// plus any HISTOGRAM columns' accumulated observations.
 type QueryResult struct {
-	Query  *Query
-	Result map[string]prometheus.Gauge // Internally we represent each facet with a JSON-encoded string for simplicity
+	Query        *Query
+	columnConfig map[string]ColumnMapping // lowercased column name -> mapping, normalized once from Query.Metrics
+	labelNames   []string
+	labelIndex   map[string]int
+	metrics      map[string]*metricSpec          // column name -> spec, for COUNTER/GAUGE columns
+	histograms   map[string]prometheus.Histogram // column name -> histogram, for HISTOGRAM columns
+
+	histogramMeta []QueryMetadata // Metadata entries for histograms, since they have no metricSpec
+
+	mu     sync.RWMutex // guards facets, which Collect reads concurrently with SetMetrics
+	facets []facetValue
 }
 
-// NewSetMetrics initializes a new metrics collector.
-func NewQueryResult(q *Query) *QueryResult {
+// Metadata returns a summary of every metric this QueryResult exposes, for
+// the exporter's /metadata endpoint.
+func (r *QueryResult) Metadata() []QueryMetadata {
+	meta := make([]QueryMetadata, 0, len(r.metrics)+len(r.histogramMeta))
+	for _, spec := range r.metrics {
+		meta = append(meta, QueryMetadata{
+			Name: spec.fqName,
+			Help: spec.help,
+			Unit: r.Query.Unit,
+			Type: string(spec.usage),
+		})
+	}
+	meta = append(meta, r.histogramMeta...)
+	return meta
+}
+
+// NewQueryResult initializes a new collector for q, building one Desc per
+// COUNTER/GAUGE column and one Histogram per HISTOGRAM column declared in
+// q.Metrics. It returns an error, rather than registering a broken
+// collector, if a derived metric name is not valid under Prometheus' naming
+// rules.
+func NewQueryResult(q *Query) (*QueryResult, error) {
 	r := &QueryResult{
-		Query:  q,
-		Result: make(map[string]prometheus.Gauge),
+		Query:        q,
+		columnConfig: make(map[string]ColumnMapping, len(q.Metrics)),
+		labelIndex:   make(map[string]int),
+		metrics:      make(map[string]*metricSpec),
+		histograms:   make(map[string]prometheus.Histogram),
+	}
+
+	// Query.Metrics keys are documented as case-insensitive; normalize them
+	// once here so SetMetrics can do a single lowercase lookup per row
+	// column instead of re-deriving a fragile match against the raw config.
+	for col, mapping := range q.Metrics {
+		r.columnConfig[strings.ToLower(col)] = mapping
+	}
+
+	labelSource := make(map[string]string) // sanitized label name -> originating column, for collision errors
+	for col, mapping := range q.Metrics {
+		if mapping.Usage == ColumnLabel {
+			sanitized := sanitizeLabelName(col)
+			if existing, ok := labelSource[sanitized]; ok {
+				return nil, fmt.Errorf("label columns %q and %q both sanitize to %q", existing, col, sanitized)
+			}
+			labelSource[sanitized] = col
+			r.labelIndex[sanitized] = len(r.labelNames)
+			r.labelNames = append(r.labelNames, sanitized)
+		}
 	}
 
-	return r
+	for col, mapping := range q.Metrics {
+		col = strings.ToLower(col)
+		name := mapping.Name
+		if name == "" {
+			name = col
+		}
+		help := mapping.Help
+		if help == "" {
+			help = q.Help
+		}
+		if help == "" {
+			help = "Result of an SQL query"
+		}
+
+		switch mapping.Usage {
+		case ColumnCounter, ColumnGauge:
+			fqName := metricName(q, name)
+			if err := validateMetricName(fqName); err != nil {
+				return nil, err
+			}
+			valueType := prometheus.GaugeValue
+			if mapping.Usage == ColumnCounter {
+				valueType = prometheus.CounterValue
+			}
+			r.metrics[col] = &metricSpec{
+				fqName:    fqName,
+				help:      help,
+				usage:     mapping.Usage,
+				valueType: valueType,
+				desc:      prometheus.NewDesc(fqName, help, r.labelNames, nil),
+			}
+		case ColumnHistogram:
+			fqName := metricName(q, name)
+			if err := validateMetricName(fqName); err != nil {
+				return nil, err
+			}
+			r.histogramMeta = append(r.histogramMeta, QueryMetadata{
+				Name: fqName,
+				Help: help,
+				Unit: q.Unit,
+				Type: string(ColumnHistogram),
+			})
+			r.histograms[col] = prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name:    fqName,
+				Help:    help,
+				Buckets: q.Buckets,
+			})
+		}
+	}
+
+	return r, nil
+}
+
+// Describe implements prometheus.Collector.
+func (r *QueryResult) Describe(ch chan<- *prometheus.Desc) {
+	for _, spec := range r.metrics {
+		ch <- spec.desc
+	}
+	for _, h := range r.histograms {
+		h.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector, emitting one ConstMetric per
+// COUNTER/GAUGE column of every facet in the most recently fetched result
+// set, plus each HISTOGRAM column's accumulated observations.
+func (r *QueryResult) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	facets := r.facets
+	r.mu.RUnlock()
+
+	for col, spec := range r.metrics {
+		for _, f := range facets {
+			v, ok := f.values[col]
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(spec.desc, spec.valueType, v, f.labels...)
+		}
+	}
+	for _, h := range r.histograms {
+		h.Collect(ch)
+	}
+}
+
+// uncheckedCollector wraps a Collector whose Collect output may carry
+// inconsistent label sets across rows (e.g. an optional label present on
+// some facets but not others). Its Describe is a no-op, which tells the
+// registry to skip consistency checking for it - the same trick
+// postgres_exporter uses for column-mapped queries.
+type uncheckedCollector struct {
+	c prometheus.Collector
+}
+
+func (u uncheckedCollector) Describe(_ chan<- *prometheus.Desc) {}
+func (u uncheckedCollector) Collect(ch chan<- prometheus.Metric) {
+	u.c.Collect(ch)
 }
 
-func (r *QueryResult) registerMetric(facets map[string]interface{}) string {
-	labels := prometheus.Labels{}
+// Exporter owns the Prometheus registry a process serves metrics from. Using
+// its own registry rather than prometheus.DefaultRegisterer keeps the
+// QueryResults registered with it apart from anything registered globally;
+// all of an exporter's QueryResults share that one registry.
+type Exporter struct {
+	Registry *prometheus.Registry
+	results  []*QueryResult
+}
 
-	jsonData, _ := json.Marshal(facets)
-	resultKey := string(jsonData)
+// NewExporter creates an Exporter with its own registry.
+func NewExporter() *Exporter {
+	return &Exporter{Registry: prometheus.NewRegistry()}
+}
 
-	for k, v := range facets {
-		labels[k] = strings.ToLower(fmt.Sprintf("%v", v))
+// Register adds r to the exporter's registry as an unchecked collector.
+func (e *Exporter) Register(r *QueryResult) error {
+	if err := e.Registry.Register(uncheckedCollector{r}); err != nil {
+		return err
 	}
+	e.results = append(e.results, r)
+	return nil
+}
 
-	if _, ok := r.Result[resultKey]; ok { // A metric with this name is already registered
-		return resultKey
+// Metadata returns a summary of every query currently registered with the
+// exporter, so operators can discover what a running instance exposes
+// without reading its YAML configuration.
+func (e *Exporter) Metadata() []QueryMetadata {
+	meta := make([]QueryMetadata, 0, len(e.results))
+	for _, r := range e.results {
+		meta = append(meta, r.Metadata()...)
 	}
+	return meta
+}
 
-	fmt.Println("Registering metric", r.Query.Name, "with facets", resultKey)
-	r.Result[resultKey] = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name:        fmt.Sprintf("query_result_%s", r.Query.Name),
-		Help:        "Result of an SQL query",
-		ConstLabels: labels,
-	})
-	prometheus.MustRegister(r.Result[resultKey])
-	return resultKey
+// ServeMetadata implements http.HandlerFunc, writing the exporter's Metadata
+// as JSON. It is intended to be mounted at "/metadata" alongside the usual
+// "/metrics" handler.
+func (e *Exporter) ServeMetadata(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.Metadata())
 }
 
 type record map[string]interface{}
 type records []record
 
-func setValueForResult(r prometheus.Gauge, v interface{}) error {
+func toFloat64(v interface{}) (float64, error) {
 	switch t := v.(type) {
 	case string:
-		f, err := strconv.ParseFloat(t, 64)
-		if err != nil {
-			return err
-		}
-		r.Set(f)
+		return strconv.ParseFloat(t, 64)
 	case int:
-		r.Set(float64(t))
+		return float64(t), nil
 	case float64:
-		r.Set(t)
+		return t, nil
 	default:
-		return fmt.Errorf("Unhandled type %s", t)
+		return 0, fmt.Errorf("Unhandled type %s", t)
 	}
-	return nil
 }
 
-func (r *QueryResult) SetMetrics(recs records) (map[string]bool, error) {
-	// Queries that return only one record should only have one column
-	if len(recs) > 1 && len(recs[0]) == 1 {
-		return nil, errors.New("There is more than one row in the query result - with a single column")
-	}
+// SetMetrics walks each row of recs once, routing every column according to
+// its declared usage in Query.Metrics: LABEL columns become the facet's
+// variable label values, COUNTER/GAUGE columns become values to report for
+// that facet, HISTOGRAM columns are observed directly, and everything else
+// (including columns absent from Metrics) is discarded.
+func (r *QueryResult) SetMetrics(recs records) error {
+	facets := make([]facetValue, 0, len(recs))
 
-	facetsWithResult := make(map[string]bool, 0)
-	if r.Query.MultiDimensional == true {
-		for _, row := range recs {
-			facet := make(map[string]interface{})
+	for _, row := range recs {
+		labelValues := make([]string, len(r.labelNames))
+		values := make(map[string]float64, len(r.metrics))
 
-			if len(row) > 1 && r.Query.DataMetric {
-				return nil, errors.New("Data metric not specified for multi-column query")
+		for col, v := range row {
+			key := strings.ToLower(col)
+			mapping, ok := r.columnConfig[key]
+			if !ok || mapping.Usage == ColumnDiscard || mapping.Usage == "" {
+				continue
 			}
 
-			for k, v := range row {
-				var (
-					isLabel bool
-				)
-				for _, label := r.Query.DataLabels {
-					if strings.ToLower(k) == strings.ToLower(label) {
-						facet[strings.ToLower(fmt.Sprintf("%v", label))] = v
-						isLabel = true;
-					}
+			switch mapping.Usage {
+			case ColumnLabel:
+				if idx, ok := r.labelIndex[sanitizeLabelName(key)]; ok {
+					labelValues[idx] = sanitizeLabelValue(strings.ToLower(fmt.Sprintf("%v", v)))
 				}
-
-				// Skip if identified as a label
-				if !isLabel {
-					if strings.ToLower(k) == r.Query.DataMetric {						
-						// Sanitise and override name of metric to a value in the result
-						r.Query.Name = ignoreNameCharRE.ReplaceAllString(v, "")
-						r.Query.Name = strings.TrimSpace(invalidNameCharRE.ReplaceAllString(v, "_"))
-					} else { // this is the actual gauge data
-						dataVal = v
-						facet[r.Query.DataLabelName] = k;
-						dataFound = true
-					}
+			case ColumnCounter, ColumnGauge:
+				// COUNTER is reported exactly like GAUGE here: the cumulative
+				// SQL value is passed straight through as a CounterValue in
+				// Collect, with no delta/reset tracking - see facetValue.
+				f, err := toFloat64(v)
+				if err != nil {
+					return err
 				}
-				
-				key := r.registerMetric(facet)
-				err := setValueForResult(r.Result[key], dataVal)
+				values[key] = f
+			case ColumnHistogram:
+				f, err := toFloat64(v)
 				if err != nil {
-					return nil, err
+					return err
 				}
-				facetsWithResult[key] = true
-				
-			}
-		}
-	} else {
-		for _, row := range recs {
-			facet := make(map[string]interface{})
-			var (
-				dataVal   interface{}
-				dataFound bool
-			)
-			if len(row) > 1 && r.Query.DataField == "" {
-				return nil, errors.New("Data field not specified for multi-column query")
-			}
-			for k, v := range row {
-				if len(row) > 1 && strings.ToLower(k) != r.Query.DataField { // facet field, add to facets
-					facet[strings.ToLower(fmt.Sprintf("%v", k))] = v
-				} else { // this is the actual gauge data
-					dataVal = v
-					dataFound = true
+				if h, ok := r.histograms[key]; ok {
+					h.Observe(f)
 				}
 			}
-
-			if !dataFound {
-				return nil, errors.New("Data field not found in result set")
-			}
-
-			key := r.registerMetric(facet)
-			err := setValueForResult(r.Result[key], dataVal)
-			if err != nil {
-				return nil, err
-			}
-			facetsWithResult[key] = true
 		}
-	}
-
-	return facetsWithResult, nil
-}
 
-func (r *QueryResult) RemoveMissingMetrics(facetsWithResult map[string]bool) {
-	for key, m := range r.Result {
-		if _, ok := facetsWithResult[key]; ok {
-			continue
+		if len(values) > 0 {
+			facets = append(facets, facetValue{labels: labelValues, values: values})
 		}
-		fmt.Println("Unregistering metric", r.Query.Name, "with facets", key)
-		prometheus.Unregister(m)
-		delete(r.Result, key)
 	}
+
+	// Build the new facet set before taking the write lock, then swap it in
+	// wholesale rather than mutating r.facets in place, so a concurrent
+	// Collect always sees either the old set or the new one in full.
+	r.mu.Lock()
+	r.facets = facets
+	r.mu.Unlock()
+	return nil
 }
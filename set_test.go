@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BenchmarkQueryResultConcurrentScrapeAndSetMetrics scrapes the registry in
+// one goroutine while SetMetrics churns the set of facets in another, to
+// guard against the race between Collect reading r.facets and SetMetrics
+// replacing it.
+func BenchmarkQueryResultConcurrentScrapeAndSetMetrics(b *testing.B) {
+	q := &Query{
+		Name: "bench",
+		Metrics: map[string]ColumnMapping{
+			"host":  {Usage: ColumnLabel},
+			"value": {Usage: ColumnGauge},
+		},
+	}
+
+	r, err := NewQueryResult(q)
+	if err != nil {
+		b.Fatalf("NewQueryResult: %v", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(uncheckedCollector{r}); err != nil {
+		b.Fatalf("Register: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			recs := records{
+				{"host": fmt.Sprintf("host-%d", i%5), "value": i},
+			}
+			if err := r.SetMetrics(recs); err != nil {
+				b.Error(err)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := registry.Gather(); err != nil {
+			b.Fatalf("Gather: %v", err)
+		}
+	}
+	b.StopTimer()
+	close(done)
+}